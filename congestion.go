@@ -0,0 +1,123 @@
+package rudp
+
+import (
+	"math"
+	"sync"
+)
+
+// Tick-domain RTO bounds and smoothing constants, modeled after the
+// classic TCP/SUFT RTO estimator (RFC 6298, ticks instead of seconds).
+const (
+	minRTO  = 2
+	maxRTO  = 200
+	initRTO = 20
+
+	rttAlpha = 0.125
+	rttBeta  = 0.25
+)
+
+// CongestionControl decides how many bytes SendMessage may have in flight
+// at once and how long RetransmitExpired waits before resending an
+// unacknowledged Message. RUDPNew installs NewDefaultCongestionControl by
+// default; set RUDP.CC to nil to disable throttling entirely.
+type CongestionControl interface {
+	// OnSent is called once a Message of size bytes moves into
+	// SendHistory.
+	OnSent(size int)
+	// OnAck is called when a Message leaves SendHistory without ever
+	// being NAKed, rttSample ticks after it entered SendHistory.
+	OnAck(size int, rttSample int)
+	// OnLoss is called when a Message is found to need retransmission,
+	// either because of an incoming TypeRequest or because its RTO fired.
+	OnLoss(size int)
+	// CanSend reports whether another Message may move into SendHistory
+	// given bytesInFlight bytes already outstanding.
+	CanSend(bytesInFlight int) bool
+	// RTO returns the current retransmission timeout, in ticks.
+	RTO() int
+}
+
+// DefaultCongestionControl is an EWMA RTT / AIMD cwnd controller in the
+// style of SUFT and the early BBR papers: cwnd grows by roughly one
+// package per RTT on ack, and is halved on loss.
+type DefaultCongestionControl struct {
+	mu sync.Mutex
+
+	cwnd    float64
+	minCwnd float64
+	maxCwnd float64
+
+	srtt   float64
+	rttvar float64
+	hasRTT bool
+}
+
+// NewDefaultCongestionControl returns a controller that starts at a
+// conservative 4-package window and may grow up to 256 packages.
+func NewDefaultCongestionControl() *DefaultCongestionControl {
+	return &DefaultCongestionControl{
+		cwnd:    4 * float64(DefaultPackageSize),
+		minCwnd: 2 * float64(DefaultPackageSize),
+		maxCwnd: 256 * float64(DefaultPackageSize),
+	}
+}
+
+func (c *DefaultCongestionControl) OnSent(size int) {}
+
+func (c *DefaultCongestionControl) OnAck(size int, rttSample int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sample := float64(rttSample)
+	if sample < 0 {
+		sample = 0
+	}
+	if !c.hasRTT {
+		c.srtt = sample
+		c.rttvar = sample / 2
+		c.hasRTT = true
+	} else {
+		c.rttvar = (1-rttBeta)*c.rttvar + rttBeta*math.Abs(c.srtt-sample)
+		c.srtt = (1-rttAlpha)*c.srtt + rttAlpha*sample
+	}
+
+	// Additive increase: roughly one package's worth of cwnd per window
+	// of acked bytes, the standard TCP-Reno shape.
+	c.cwnd += float64(size) * float64(DefaultPackageSize) / c.cwnd
+	if c.cwnd > c.maxCwnd {
+		c.cwnd = c.maxCwnd
+	}
+}
+
+func (c *DefaultCongestionControl) OnLoss(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cwnd *= 0.5
+	if c.cwnd < c.minCwnd {
+		c.cwnd = c.minCwnd
+	}
+}
+
+func (c *DefaultCongestionControl) CanSend(bytesInFlight int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return float64(bytesInFlight) < c.cwnd
+}
+
+func (c *DefaultCongestionControl) RTO() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.hasRTT {
+		return initRTO
+	}
+	rto := c.srtt + 4*c.rttvar
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return int(math.Ceil(rto))
+}
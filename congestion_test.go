@@ -0,0 +1,60 @@
+package rudp
+
+import "testing"
+
+func TestDefaultCongestionControlRTOUsesInitBeforeFirstSample(t *testing.T) {
+	cc := NewDefaultCongestionControl()
+	if rto := cc.RTO(); rto != initRTO {
+		t.Fatalf("RTO() before any sample = %d, want initRTO (%d)", rto, initRTO)
+	}
+}
+
+func TestDefaultCongestionControlRTOTracksRTTSamples(t *testing.T) {
+	cc := NewDefaultCongestionControl()
+	cc.OnAck(DefaultPackageSize, 10)
+	if rto := cc.RTO(); rto < minRTO || rto > maxRTO {
+		t.Fatalf("RTO() = %d, want in [%d, %d]", rto, minRTO, maxRTO)
+	}
+
+	// A wildly larger sample should push srtt, and so RTO, up.
+	before := cc.RTO()
+	cc.OnAck(DefaultPackageSize, 1000)
+	if after := cc.RTO(); after <= before {
+		t.Fatalf("RTO() after a much larger RTT sample = %d, want > %d", after, before)
+	}
+}
+
+func TestDefaultCongestionControlCwndGrowsOnAckAndHalvesOnLoss(t *testing.T) {
+	cc := NewDefaultCongestionControl()
+
+	if !cc.CanSend(0) {
+		t.Fatal("CanSend(0) = false on a fresh controller, want true")
+	}
+
+	// OnAck grows cwnd, so more bytes should fit in flight afterwards.
+	for i := 0; i < 50; i++ {
+		cc.OnAck(DefaultPackageSize, 10)
+	}
+	grownCwnd := cc.cwnd
+	if grownCwnd <= 4*float64(DefaultPackageSize) {
+		t.Fatalf("cwnd after repeated acks = %v, want > initial 4*%d", grownCwnd, DefaultPackageSize)
+	}
+
+	cc.OnLoss(DefaultPackageSize)
+	if cc.cwnd >= grownCwnd {
+		t.Fatalf("cwnd after OnLoss = %v, want < pre-loss cwnd %v", cc.cwnd, grownCwnd)
+	}
+	if cc.cwnd < cc.minCwnd {
+		t.Fatalf("cwnd after OnLoss = %v, want >= minCwnd %v", cc.cwnd, cc.minCwnd)
+	}
+}
+
+func TestDefaultCongestionControlCanSendRespectsCwnd(t *testing.T) {
+	cc := NewDefaultCongestionControl()
+	if cc.CanSend(int(cc.maxCwnd)) {
+		t.Fatal("CanSend with bytesInFlight >= maxCwnd = true, want false")
+	}
+	if !cc.CanSend(0) {
+		t.Fatal("CanSend(0) = false, want true")
+	}
+}
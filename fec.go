@@ -0,0 +1,235 @@
+package rudp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// fecHeaderSize is the size of the header prepended to every shard:
+// (group_id:4, shard_index:1, data_shards:1, parity_shards:1).
+const fecHeaderSize = 4 + 1 + 1 + 1
+
+// fecMaxGroups bounds how many in-flight FEC groups the receive side
+// keeps around; the oldest group is dropped once this is exceeded, same
+// as SendHistory is bounded by Expired rather than growing forever.
+const fecMaxGroups = 64
+
+// fecState implements the optional Reed-Solomon FEC layer installed by
+// RUDPNewWithFEC. On the send side it groups GenOutPackage's output into
+// shard windows and computes parity shards; on the receive side it
+// buffers shards per group_id and reconstructs missing data shards once
+// enough of the group has arrived.
+type fecState struct {
+	cfg FECConfig
+	enc reedsolomon.Encoder
+
+	mu          sync.Mutex
+	nextGroupID uint32
+	order       *list.List
+	index       map[uint32]*list.Element
+}
+
+// FECConfig is the Reed-Solomon shard layout of a session.
+type FECConfig struct {
+	DataShards   int
+	ParityShards int
+}
+
+type fecGroup struct {
+	id           uint32
+	dataShards   int
+	parityShards int
+	shards       [][]byte
+	have         int
+	// lengths holds the true, pre-padding byte length of each data shard
+	// (2 bytes each, big-endian), copied from whichever shard of the
+	// group arrived first; every shard in a group carries the same
+	// table so it survives the loss of any single data shard.
+	lengths []byte
+}
+
+func newFECState(cfg FECConfig) (*fecState, error) {
+	enc, err := reedsolomon.New(cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &fecState{
+		cfg:   cfg,
+		enc:   enc,
+		order: list.New(),
+		index: make(map[uint32]*list.Element),
+	}, nil
+}
+
+// encode groups pkgs into windows of cfg.DataShards packages, computes
+// cfg.ParityShards parity shards for each window, and returns the full set
+// of shards (data and parity) as RUDPPackages with the FEC header
+// prepended, ready to go on the wire in place of pkgs.
+func (f *fecState) encode(pkgs *list.List) *list.List {
+	out := list.New()
+	if pkgs == nil {
+		return out
+	}
+
+	batch := make([][]byte, 0, f.cfg.DataShards)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		f.mu.Lock()
+		groupID := f.nextGroupID
+		f.nextGroupID++
+		f.mu.Unlock()
+
+		shardSize := 0
+		for _, b := range batch {
+			if len(b) > shardSize {
+				shardSize = len(b)
+			}
+		}
+		shards := make([][]byte, f.cfg.DataShards+f.cfg.ParityShards)
+		for i := range shards {
+			shards[i] = make([]byte, shardSize)
+		}
+		for i, b := range batch {
+			copy(shards[i], b)
+		}
+
+		if err := f.enc.Encode(shards); err != nil {
+			batch = batch[:0]
+			return
+		}
+
+		lengths := make([]byte, f.cfg.DataShards*2)
+		for i, b := range batch {
+			binary.BigEndian.PutUint16(lengths[i*2:], uint16(len(b)))
+		}
+
+		for i, s := range shards {
+			buf := make([]byte, fecHeaderSize+len(lengths)+len(s))
+			binary.BigEndian.PutUint32(buf[0:4], groupID)
+			buf[4] = byte(i)
+			buf[5] = byte(f.cfg.DataShards)
+			buf[6] = byte(f.cfg.ParityShards)
+			copy(buf[fecHeaderSize:], lengths)
+			copy(buf[fecHeaderSize+len(lengths):], s)
+			out.PushBack(RUDPPackage{Size: len(buf), Buf: buf})
+		}
+		batch = batch[:0]
+	}
+
+	for e := pkgs.Front(); e != nil; e = e.Next() {
+		pkg, ok := e.Value.(RUDPPackage)
+		if !ok {
+			continue
+		}
+		batch = append(batch, pkg.Buf[:pkg.Size])
+		if len(batch) == f.cfg.DataShards {
+			flush()
+		}
+	}
+	flush()
+
+	return out
+}
+
+// onShard ingests one received FEC shard. Once cfg.DataShards shards of
+// its group have either arrived directly or been reconstructed, it
+// returns the original package payloads, in order, ready for
+// ExtractPackage. It returns nil while the group is still incomplete.
+func (f *fecState) onShard(buf []byte) [][]byte {
+	if len(buf) < fecHeaderSize {
+		return nil
+	}
+	groupID := binary.BigEndian.Uint32(buf[0:4])
+	shardIndex := int(buf[4])
+	dataShards := int(buf[5])
+	parityShards := int(buf[6])
+
+	lengthsSize := dataShards * 2
+	if len(buf) < fecHeaderSize+lengthsSize {
+		return nil
+	}
+	lengths := buf[fecHeaderSize : fecHeaderSize+lengthsSize]
+	payload := append([]byte(nil), buf[fecHeaderSize+lengthsSize:]...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	g := f.group(groupID, dataShards, parityShards)
+	if shardIndex < 0 || shardIndex >= len(g.shards) || g.shards[shardIndex] != nil {
+		return nil
+	}
+	g.shards[shardIndex] = payload
+	g.have++
+	if g.lengths == nil {
+		g.lengths = append([]byte(nil), lengths...)
+	}
+
+	if g.have < g.dataShards {
+		return nil
+	}
+	if g.have < len(g.shards) {
+		if err := f.enc.Reconstruct(g.shards); err != nil {
+			return nil
+		}
+	}
+
+	f.evictLocked(groupID)
+	out := make([][]byte, g.dataShards)
+	for i := 0; i < g.dataShards; i++ {
+		n := int(binary.BigEndian.Uint16(g.lengths[i*2:]))
+		if n > len(g.shards[i]) {
+			n = len(g.shards[i])
+		}
+		out[i] = g.shards[i][:n]
+	}
+	return out
+}
+
+func (f *fecState) group(id uint32, dataShards, parityShards int) *fecGroup {
+	if el, ok := f.index[id]; ok {
+		f.order.MoveToFront(el)
+		return el.Value.(*fecGroup)
+	}
+	g := &fecGroup{
+		id:           id,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		shards:       make([][]byte, dataShards+parityShards),
+	}
+	el := f.order.PushFront(g)
+	f.index[id] = el
+
+	if f.order.Len() > fecMaxGroups {
+		back := f.order.Back()
+		delete(f.index, back.Value.(*fecGroup).id)
+		f.order.Remove(back)
+	}
+	return g
+}
+
+func (f *fecState) evictLocked(id uint32) {
+	if el, ok := f.index[id]; ok {
+		f.order.Remove(el)
+		delete(f.index, id)
+	}
+}
+
+// RUDPNewWithFEC is RUDPNew plus an optional Reed-Solomon FEC layer: every
+// dataShards outgoing packages are shipped alongside parityShards parity
+// packages, letting the receiver recover a single lost shard per group
+// without a round trip.
+func RUDPNewWithFEC(sendDelay, expire, dataShards, parityShards int) (*RUDP, error) {
+	fec, err := newFECState(FECConfig{DataShards: dataShards, ParityShards: parityShards})
+	if err != nil {
+		return nil, err
+	}
+	u := RUDPNew(sendDelay, expire)
+	u.fec = fec
+	return u, nil
+}
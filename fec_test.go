@@ -0,0 +1,126 @@
+package rudp
+
+import (
+	"container/list"
+	"testing"
+)
+
+func packagesOf(payloads ...string) *list.List {
+	l := list.New()
+	for _, p := range payloads {
+		l.PushBack(RUDPPackage{Size: len(p), Buf: []byte(p)})
+	}
+	return l
+}
+
+// TestFECEncodeReconstructRecoversLostShard checks the core promise of the
+// FEC layer: losing any single shard of a group - including a data shard
+// shorter than the group's padded shardSize - must still reconstruct every
+// original payload at its true length.
+func TestFECEncodeReconstructRecoversLostShard(t *testing.T) {
+	cfg := FECConfig{DataShards: 3, ParityShards: 1}
+	payloads := []string{"a", "bcdef", "ghi"}
+
+	sendFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+	shards := sendFEC.encode(packagesOf(payloads...))
+	if n := shards.Len(); n != cfg.DataShards+cfg.ParityShards {
+		t.Fatalf("encode produced %d shards, want %d", n, cfg.DataShards+cfg.ParityShards)
+	}
+
+	recvFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+
+	var got [][]byte
+	i := 0
+	for e := shards.Front(); e != nil; e = e.Next() {
+		pkg := e.Value.(RUDPPackage)
+		if i == 1 {
+			// Drop data shard 1 - the group must still reconstruct from
+			// the remaining 2 data shards plus the 1 parity shard.
+			i++
+			continue
+		}
+		i++
+		if out := recvFEC.onShard(pkg.Buf[:pkg.Size]); out != nil {
+			got = out
+		}
+	}
+
+	if got == nil {
+		t.Fatal("group never completed after losing one data shard")
+	}
+	if len(got) != len(payloads) {
+		t.Fatalf("reconstructed %d payloads, want %d", len(got), len(payloads))
+	}
+	for i, want := range payloads {
+		if string(got[i]) != want {
+			t.Fatalf("payload %d = %q, want %q", i, got[i], want)
+		}
+	}
+}
+
+// TestFECOnShardWithoutLossPreservesLength checks the common case - no
+// shard lost - still truncates every data shard back to its true length
+// instead of leaving it zero-padded to shardSize.
+func TestFECOnShardWithoutLossPreservesLength(t *testing.T) {
+	cfg := FECConfig{DataShards: 2, ParityShards: 1}
+	payloads := []string{"short", "a little bit longer"}
+
+	sendFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+	shards := sendFEC.encode(packagesOf(payloads...))
+
+	recvFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+
+	var got [][]byte
+	for e := shards.Front(); e != nil; e = e.Next() {
+		pkg := e.Value.(RUDPPackage)
+		if out := recvFEC.onShard(pkg.Buf[:pkg.Size]); out != nil {
+			got = out
+		}
+	}
+
+	if got == nil {
+		t.Fatal("group never completed with all shards present")
+	}
+	for i, want := range payloads {
+		if len(got[i]) != len(want) {
+			t.Fatalf("payload %d length = %d, want %d (got %q)", i, len(got[i]), len(want), got[i])
+		}
+		if string(got[i]) != want {
+			t.Fatalf("payload %d = %q, want %q", i, got[i], want)
+		}
+	}
+}
+
+// TestFECOnShardIncompleteGroupReturnsNil checks that a group short of
+// DataShards arrivals reports nothing yet, rather than reconstructing from
+// partial data or panicking.
+func TestFECOnShardIncompleteGroupReturnsNil(t *testing.T) {
+	cfg := FECConfig{DataShards: 2, ParityShards: 1}
+	sendFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+	shards := sendFEC.encode(packagesOf("x", "y"))
+
+	recvFEC, err := newFECState(cfg)
+	if err != nil {
+		t.Fatalf("newFECState: %v", err)
+	}
+
+	first := shards.Front().Value.(RUDPPackage)
+	if out := recvFEC.onShard(first.Buf[:first.Size]); out != nil {
+		t.Fatalf("onShard with only 1 of %d data shards = %v, want nil", cfg.DataShards, out)
+	}
+}
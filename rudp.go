@@ -1,31 +1,56 @@
 package rudp
 
 import (
-	"bytes"
 	"container/list"
-	"encoding/binary"
 	"errors"
+	"sync"
 )
 
-const (
-	DefaultPackageSize = 512
-	ErrCorrupt         = errors.New("corrupt")
-)
+const DefaultPackageSize = 512
 
+var ErrCorrupt = errors.New("corrupt")
+
+// TypeNormal's numeric value must never change: it is the boundary a
+// default-frame's length is computed against (see ExtractPackage/
+// PackMessage), and any peer that only understands the original four
+// types has it hardcoded at 4. New control frame types are appended
+// after it, never inserted before.
 const (
 	TypeIgnore = iota
 	TypeCorrupt
 	TypeRequest
 	TypeMissing
 	TypeNormal
+	TypeSackRange
+	TypeCapability
 )
 
+// CapSack is the capability bit advertised in the TypeCapability frame
+// every RUDP sends as the first package of a session: it means "I
+// understand TypeSackRange". Both ends must advertise it before either
+// emits one, so peers that predate SACK support keep getting the legacy
+// per-ID TypeRequest/TypeMissing chatter instead.
+const CapSack = 1 << 0
+
+// maxSackBitmapBytes bounds a single TypeSackRange frame's bitmap so the
+// whole frame (tag + base id + bitmap length + bitmap) stays near 32
+// bytes.
+const maxSackBitmapBytes = 31
+
 type Message struct {
 	Size int
 	Cap  int
 	ID   int
 	Tick int
 	Buf  []byte
+
+	// SentTick is the CurrentTick at which this Message moved into
+	// SendHistory, used by the CongestionControl to derive RTT samples.
+	SentTick int
+	// Naked is set once a TypeRequest has been seen for this Message's ID,
+	// so it is not double-counted as an ack when it later leaves
+	// SendHistory.
+	Naked bool
 }
 
 type RUDPPackage struct {
@@ -41,6 +66,11 @@ type PackageIndex struct {
 }
 
 type RUDP struct {
+	// mu guards every field below. RUDPSend, RUDPRecv, RUDPUpdate, and
+	// RUDPDelete take it; everything they call internally assumes it is
+	// already held, so none of those helpers re-lock it.
+	mu sync.Mutex
+
 	SendQueue   *list.List
 	RecvQueue   *list.List
 	SendHistory *list.List
@@ -59,6 +89,27 @@ type RUDP struct {
 	RecvIdMax      int
 	SendDelay      int
 	Expired        int
+
+	// CC is the congestion controller driving the cwnd check in
+	// SendMessage and the RTO used by RetransmitExpired. Defaults to
+	// NewDefaultCongestionControl; set to nil to send unthrottled.
+	CC CongestionControl
+	// BytesInFlight is the sum of Cap for every Message currently sitting
+	// in SendHistory awaiting an ack or a NAK.
+	BytesInFlight int
+
+	// LocalSackCapable is the CapSack bit this RUDP advertises in its
+	// first outgoing TypeCapability frame.
+	LocalSackCapable bool
+	// PeerSackCapable records whether the remote side's TypeCapability
+	// frame advertised CapSack.
+	PeerSackCapable bool
+	sentCapability  bool
+
+	// fec is non-nil when this RUDP was created with RUDPNewWithFEC; it
+	// shards outgoing packages with Reed-Solomon parity and reassembles
+	// incoming ones in RUDPUpdate.
+	fec *fecState
 }
 
 func RUDPNew(sendDlay int, ExpireTime int) *RUDP {
@@ -66,6 +117,13 @@ func RUDPNew(sendDlay int, ExpireTime int) *RUDP {
 	u.SendQueue = list.New()
 	u.RecvQueue = list.New()
 	u.SendHistory = list.New()
+	u.FreeList = list.New()
+	u.CC = NewDefaultCongestionControl()
+	u.LocalSackCapable = true
+	// SendId is pre-incremented before use (see RUDPSend), so the first
+	// message either side ever sends has ID 1; RecvIdMin starts there to
+	// match instead of waiting on an ID 0 that never comes.
+	u.RecvIdMin = 1
 
 	u.SendPackage = list.New()
 	u.SendDelay = sendDlay
@@ -73,19 +131,27 @@ func RUDPNew(sendDlay int, ExpireTime int) *RUDP {
 	return u
 }
 
+// sackEnabled reports whether both ends have negotiated TypeSackRange
+// support.
+func (u *RUDP) sackEnabled() bool {
+	return u.LocalSackCapable && u.PeerSackCapable
+}
+
 func ClearOutPacakge(u *RUDP) {
-	for e := u.SendPackage.Front(); e != nil; e = e.Next() {
-		u.SendPackage.Remove(e)
-	}
+	u.SendPackage.Init()
 }
 
+// ClearMessageQueue empties l. Using Init instead of removing elements
+// one at a time matters: Remove invalidates the element it was called on,
+// so a "for e := l.Front(); e != nil; e = e.Next() { l.Remove(e) }" loop
+// only ever removes the first element before e.Next() returns nil.
 func ClearMessageQueue(l *list.List) {
-	for e := l.Front(); e != nil; e = e.Next() {
-		l.Remove(e)
-	}
+	l.Init()
 }
 
 func RUDPDelete(u *RUDP) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	ClearMessageQueue(u.SendQueue)
 	ClearMessageQueue(u.RecvQueue)
 	ClearMessageQueue(u.SendHistory)
@@ -94,12 +160,14 @@ func RUDPDelete(u *RUDP) {
 }
 
 func NewMessage(u *RUDP, buf []byte, size int) *Message {
-	ele := make(Message)
-	copy(ele.Buf, buf)
-	ele.Tick = 0
-	ele.ID = 0
-	ele.Size = size
-	ele.Cap = DefaultPackageSize
+	ele := &Message{
+		Size: size,
+		Cap:  DefaultPackageSize,
+	}
+	if size > 0 {
+		ele.Buf = make([]byte, size)
+		copy(ele.Buf, buf)
+	}
 
 	u.FreeList.PushFront(ele)
 	return ele
@@ -119,9 +187,11 @@ func RemoveMessage(u *RUDP, m *Message) {
 	}
 }
 
+// QueuePush appends m to the back of q, keeping SendQueue/RecvQueue in the
+// ascending-ID order SendMessage/RequestMissing rely on.
 func QueuePush(q *list.List, m *Message) {
 	if q != nil && m != nil {
-		q.PushFront(m)
+		q.PushBack(m)
 	}
 }
 
@@ -139,6 +209,8 @@ func QueuePop(q *list.List, id int) *Message {
 }
 
 func RUDPSend(u *RUDP, buf []byte, size int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	m := NewMessage(u, buf, size)
 	u.SendId++
 	m.ID = u.SendId
@@ -147,7 +219,9 @@ func RUDPSend(u *RUDP, buf []byte, size int) {
 }
 
 func RUDPRecv(u *RUDP) (res []byte, err error) {
-	if u.Corrupt {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Corrupt != 0 {
 		u.Corrupt = 0
 		return res, ErrCorrupt
 	}
@@ -157,19 +231,126 @@ func RUDPRecv(u *RUDP) (res []byte, err error) {
 		return res, nil
 	}
 	u.RecvIdMin++
-	copy(res, m.Buf)
+	res = m.Buf
 	RemoveMessage(u, m)
 	return
 }
 
-func ClearSendExpired(u *RUDP, tick int) {
-	for e := u.SendHistory.Back(); e != nil; e = e.Prev() {
+// ClearSendExpired drops every SendHistory entry older than cutoff tick -
+// i.e. one that has sat unacknowledged for more than Expired ticks since it
+// was queued, not merely one created before the last sweep.
+func ClearSendExpired(u *RUDP, cutoff int) {
+	for e := u.SendHistory.Back(); e != nil; {
+		prev := e.Prev()
 		msg, ok := e.Value.(*Message)
 		if ok {
-			if msg.Tick >= tick {
+			if msg.Tick < cutoff {
+				// No TypeRequest arrived for this Message before it aged
+				// out, so treat it as implicitly delivered.
+				if u.CC != nil && !msg.Naked {
+					u.CC.OnAck(msg.Cap, u.CurrentTick-msg.SentTick)
+				}
+				u.BytesInFlight -= msg.Cap
+				if u.BytesInFlight < 0 {
+					u.BytesInFlight = 0
+				}
 				u.SendHistory.Remove(e)
 			}
 		}
+		e = prev
+	}
+}
+
+// findSendHistory returns the Message with the given id still sitting in
+// u.SendHistory, or nil if it has already left.
+func findSendHistory(u *RUDP, id int) *Message {
+	e := findSendHistoryElement(u, id)
+	if e == nil {
+		return nil
+	}
+	msg, _ := e.Value.(*Message)
+	return msg
+}
+
+func findSendHistoryElement(u *RUDP, id int) *list.Element {
+	for e := u.SendHistory.Front(); e != nil; e = e.Next() {
+		msg, ok := e.Value.(*Message)
+		if ok && msg.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// ApplySackRange processes an incoming TypeSackRange frame: each set bit
+// marks baseID+i as received by the peer, so that Message is acked and
+// dropped from SendHistory immediately instead of waiting for Expired;
+// each unset bit is queued in SendAgain for retransmission exactly as a
+// legacy TypeRequest would have done. Unset bits for ids this side has not
+// sent yet (still in SendQueue or not yet queued) are ignored: they are the
+// padding past the peer's RecvIdMax, not gaps.
+func ApplySackRange(u *RUDP, baseID int, bitmap []byte) {
+	maxSent := u.SendId
+	if e := u.SendQueue.Front(); e != nil {
+		if m, ok := e.Value.(*Message); ok {
+			maxSent = m.ID - 1
+		}
+	}
+	for i, b := range bitmap {
+		for bit := 0; bit < 8; bit++ {
+			id := baseID + i*8 + bit
+			if b&(1<<uint(bit)) != 0 {
+				e := findSendHistoryElement(u, id)
+				if e == nil {
+					continue
+				}
+				msg := e.Value.(*Message)
+				if u.CC != nil && !msg.Naked {
+					u.CC.OnAck(msg.Cap, u.CurrentTick-msg.SentTick)
+				}
+				u.BytesInFlight -= msg.Cap
+				if u.BytesInFlight < 0 {
+					u.BytesInFlight = 0
+				}
+				u.SendHistory.Remove(e)
+			} else {
+				msg := findSendHistory(u, id)
+				if msg == nil && id > maxSent {
+					continue
+				}
+				u.SendAgain.A = append(u.SendAgain.A, id)
+				if msg != nil && !msg.Naked && u.CC != nil {
+					msg.Naked = true
+					u.CC.OnLoss(msg.Cap)
+				}
+			}
+		}
+	}
+}
+
+// RetransmitExpired resends any SendHistory entry that has gone a full RTO
+// since it was last sent by SendMessage or RetransmitExpired, whether or not
+// it was NAKed, so a fully-lost tail still recovers even if the peer never
+// emits a TypeRequest for it.
+func RetransmitExpired(u *RUDP, tmp *TmpBuffer) {
+	if u.CC == nil {
+		return
+	}
+	rto := u.CC.RTO()
+	for e := u.SendHistory.Front(); e != nil; e = e.Next() {
+		msg, ok := e.Value.(*Message)
+		if !ok {
+			continue
+		}
+		if u.CurrentTick-msg.SentTick < rto {
+			continue
+		}
+		PackMessage(u, tmp, msg)
+		if !msg.Naked {
+			msg.Naked = true
+			u.CC.OnLoss(msg.Cap)
+		}
+		msg.SentTick = u.CurrentTick
 	}
 }
 
@@ -197,13 +378,23 @@ func InsertMessage(u *RUDP, id int, buf []byte, size int) {
 		for e := u.RecvQueue.Back(); e != nil; e = e.Prev() {
 			msg, ok := e.Value.(*Message)
 			if ok {
-				if msg.ID > id {
+				if msg.ID == id {
+					return
+				}
+				if msg.ID < id {
 					m := NewMessage(u, buf, size)
-					u.RecvQueue.InsertAfter(u, e)
+					m.ID = id
+					u.RecvQueue.InsertAfter(m, e)
 					return
 				}
 			}
 		}
+		// id is smaller than every element currently queued (it's filling
+		// the lowest gap while higher IDs already arrived) - insert it at
+		// the front instead of dropping it.
+		m := NewMessage(u, buf, size)
+		m.ID = id
+		u.RecvQueue.PushFront(m)
 	}
 }
 
@@ -213,13 +404,13 @@ func AddMissing(u *RUDP, id int) {
 
 func ExtractPackage(u *RUDP, buf []byte, size int) {
 	for size > 0 {
-		length := intbuf[0]
+		length := int(buf[0])
 		if length > 127 {
 			if size <= 1 {
 				u.Corrupt = 1
 				return
 			}
-			length = (length*256 + buffer[1]) & 0x7fff
+			length = (length*256 + int(buf[1])) & 0x7fff
 			buf = buf[2:]
 			size = size - 2
 		} else {
@@ -228,7 +419,7 @@ func ExtractPackage(u *RUDP, buf []byte, size int) {
 		}
 		switch length {
 		case TypeIgnore:
-			if u.SendAgain.N == 0 {
+			if len(u.SendAgain.A) == 0 {
 				u.SendAgain.A = append(u.SendAgain.A, u.RecvIdMin)
 			}
 		case TypeCorrupt:
@@ -242,12 +433,40 @@ func ExtractPackage(u *RUDP, buf []byte, size int) {
 				return
 			}
 			if length == TypeRequest {
-				u.SendAgain.A = append(u.SendAgain.A, GetID(u, buf))
+				id := GetID(u, buf)
+				u.SendAgain.A = append(u.SendAgain.A, id)
+				if msg := findSendHistory(u, id); msg != nil && !msg.Naked && u.CC != nil {
+					msg.Naked = true
+					u.CC.OnLoss(msg.Cap)
+				}
 			} else {
 				AddMissing(u, GetID(u, buf))
 			}
 			buf = buf[2:]
 			size = size - 2
+		case TypeSackRange:
+			if size < 3 {
+				u.Corrupt = 1
+				return
+			}
+			baseID := GetID(u, buf)
+			bitmapLen := int(buf[2])
+			if size < 3+bitmapLen {
+				u.Corrupt = 1
+				return
+			}
+			ApplySackRange(u, baseID, buf[3:3+bitmapLen])
+			buf = buf[3+bitmapLen:]
+			size = size - 3 - bitmapLen
+		case TypeCapability:
+			if size < 2 {
+				u.Corrupt = 1
+				return
+			}
+			flags := GetID(u, buf) // reuses the 2-byte id slot as flag bits
+			u.PeerSackCapable = flags&CapSack != 0
+			buf = buf[2:]
+			size = size - 2
 		default:
 			length = length - TypeNormal
 			if size < length+2 {
@@ -272,132 +491,239 @@ type TmpBuffer struct {
 func NewPacakge(u *RUDP, tmp *TmpBuffer) {
 	p := RUDPPackage{}
 	p.Size = tmp.Size
-	copy(p.Buf, tmp.Buf)
+	p.Buf = make([]byte, tmp.Size)
+	copy(p.Buf, tmp.Buf[:tmp.Size])
 	tmp.Packages.PushBack(p)
 	tmp.Size = 0
 }
 
-func FillHeader(buf []byte, length int, id int) (offset int, size int) {
-	//var size int
+// FillHeader writes a frame's (length/type, id) header to buf[0:] and
+// returns the number of bytes written.
+func FillHeader(buf []byte, length int, id int) int {
+	offset := 1
 	if length < 128 {
-		buf[0] = length
-		size = 1
-		offset = 1
+		buf[0] = byte(length)
 	} else {
-		buf[0] = ((lenn & 0x7f00) >> 8) | 0x89
-		buf[1] = len & 0xff
-		size = 2
+		buf[0] = byte((length&0x7f00)>>8) | 0x80
+		buf[1] = byte(length & 0xff)
 		offset = 2
 	}
-	buf[offset] = (id & 0xff00) >> 8
-	buf[offset+1] = (id & 0xff)
-	size = size + 2
-	offset = offset + 2
-	return size
+	buf[offset] = byte((id & 0xff00) >> 8)
+	buf[offset+1] = byte(id & 0xff)
+	return offset + 2
 }
 
 func PackRequest(u *RUDP, tmp *TmpBuffer, id int, tag int) {
-	size := DefaultPackageSize - tmp.Size
-	if size < 3 {
+	if DefaultPackageSize-tmp.Size < 4 {
 		NewPacakge(u, tmp)
 	}
-	_, size = FillHeader(tmp.Buf, tag, id)
-	tmp.Size += size
+	tmp.Size += FillHeader(tmp.Buf[tmp.Size:], tag, id)
+}
+
+// PackSackRange writes a TypeSackRange frame covering ids
+// [baseID, baseID+len(bitmap)*8).
+func PackSackRange(u *RUDP, tmp *TmpBuffer, baseID int, bitmap []byte) {
+	need := 4 + 1 + len(bitmap)
+	if DefaultPackageSize-tmp.Size < need {
+		NewPacakge(u, tmp)
+	}
+	base := tmp.Size
+	n := FillHeader(tmp.Buf[base:], TypeSackRange, baseID)
+	tmp.Buf[base+n] = byte(len(bitmap))
+	copy(tmp.Buf[base+n+1:], bitmap)
+	tmp.Size += n + 1 + len(bitmap)
+}
+
+// PackCapability writes the TypeCapability frame this RUDP announces as
+// the first package of a session.
+func PackCapability(u *RUDP, tmp *TmpBuffer) {
+	if DefaultPackageSize-tmp.Size < 4 {
+		NewPacakge(u, tmp)
+	}
+	flags := 0
+	if u.LocalSackCapable {
+		flags |= CapSack
+	}
+	tmp.Size += FillHeader(tmp.Buf[tmp.Size:], TypeCapability, flags)
 }
 
 func PackMessage(u *RUDP, tmp *TmpBuffer, m *Message) {
-	size := DefaultPackageSize - tmp.Size
 	if m.Size > DefaultPackageSize-4 {
 		if tmp.Size > 0 {
 			NewPacakge(u, tmp)
 		}
-		size = 4 + m.Size
-		p := &RUDPPackage{}
+		p := RUDPPackage{Buf: make([]byte, 4+m.Size)}
 		FillHeader(p.Buf, m.Size+TypeNormal, m.ID)
-		p.Buf = append(p.Buf[0:4], m.Buf...)
+		copy(p.Buf[4:], m.Buf)
+		p.Size = len(p.Buf)
 		tmp.Packages.PushBack(p)
+		return
+	}
+	if DefaultPackageSize-tmp.Size < 4+m.Size {
+		NewPacakge(u, tmp)
 	}
+	n := FillHeader(tmp.Buf[tmp.Size:], m.Size+TypeNormal, m.ID)
+	copy(tmp.Buf[tmp.Size+n:], m.Buf)
+	tmp.Size += n + m.Size
 }
 
+// RequestMissing asks the peer to resend whatever RecvQueue gaps remain.
+// When both ends negotiated CapSack, gaps are coalesced into TypeSackRange
+// frames; otherwise it falls back to one legacy TypeRequest per missing
+// ID.
 func RequestMissing(u *RUDP, tmp *TmpBuffer) {
+	if u.sackEnabled() {
+		requestMissingSack(u, tmp)
+		return
+	}
 	id := u.RecvIdMin
-	//m = u.RecvQueue.Front()
-	for m := u.RecvQueue.Front(); m != nil; m = m.Next() {
-		ele, _ := (*Message)(m)
-		if ele.ID > id {
-			for i := id; i < ele.ID; i++ {
+	for e := u.RecvQueue.Front(); e != nil; e = e.Next() {
+		msg, ok := e.Value.(*Message)
+		if !ok {
+			continue
+		}
+		if msg.ID > id {
+			for i := id; i < msg.ID; i++ {
 				PackRequest(u, tmp, i, TypeRequest)
 			}
 		}
-		id = ele.ID + 1
+		id = msg.ID + 1
+	}
+}
+
+// requestMissingSack coalesces [RecvIdMin, RecvIdMax] into one or more
+// TypeSackRange frames of maxSackBitmapBytes each. Every frame carries a
+// full bitmap; bits for ids past RecvIdMax are left unset.
+func requestMissingSack(u *RUDP, tmp *TmpBuffer) {
+	if u.RecvIdMax < u.RecvIdMin {
+		return
+	}
+	present := make(map[int]bool)
+	for e := u.RecvQueue.Front(); e != nil; e = e.Next() {
+		if msg, ok := e.Value.(*Message); ok {
+			present[msg.ID] = true
+		}
+	}
+	windowBits := maxSackBitmapBytes * 8
+	for base := u.RecvIdMin; base <= u.RecvIdMax; base += windowBits {
+		bitmap := make([]byte, maxSackBitmapBytes)
+		for i := 0; i < windowBits; i++ {
+			id := base + i
+			if id > u.RecvIdMax {
+				break
+			}
+			if present[id] {
+				bitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		PackSackRange(u, tmp, base, bitmap)
 	}
 }
 
 func ReplyRequest(u *RUDP, tmp *TmpBuffer) {
-	m := u.SendHistory.Front()
-	for i := 0; i < u.SendAgain.N; i++ {
-		id := u.SendAgain.A[i]
+	e := u.SendHistory.Front()
+	for _, id := range u.SendAgain.A {
 		if id < u.RecvIdMin {
 			continue
 		}
 		for {
-			if m != nil {
-				his, _ := (*Message)(m)
-				if id < his.ID {
-					PackRequest(u, tmp, id, TypeMissing)
-					break
-				} else if id == his.ID {
-					PackMessage(u, tmp, his)
-					break
-				}
-			} else {
+			if e == nil {
 				PackRequest(u, tmp, id, TypeMissing)
 				break
 			}
-			m = m.Next()
+			his, ok := e.Value.(*Message)
+			if !ok {
+				e = e.Next()
+				continue
+			}
+			if id < his.ID {
+				PackRequest(u, tmp, id, TypeMissing)
+				break
+			} else if id == his.ID {
+				PackMessage(u, tmp, his)
+				break
+			}
+			e = e.Next()
 		}
 	}
+	u.SendAgain.A = u.SendAgain.A[:0]
 	u.SendAgain.N = 0
 }
 
+// SendMessage moves Messages from SendQueue to SendHistory, handing each
+// to PackMessage on the way. It stops as soon as the congestion controller
+// reports the window is full, leaving the remainder in SendQueue for a
+// later tick.
 func SendMessage(u *RUDP, tmp *TmpBuffer) {
-	for m := u.SendQueue.Front(); m != nil; m = m.Next() {
-		ele, _ := (*Message)(m)
+	for e := u.SendQueue.Front(); e != nil; {
+		next := e.Next()
+		ele, ok := e.Value.(*Message)
+		if !ok {
+			e = next
+			continue
+		}
+		if u.CC != nil && !u.CC.CanSend(u.BytesInFlight) {
+			break
+		}
 		PackMessage(u, tmp, ele)
-		u.SendHistory.PushBack(m)
-		u.SendQueue.Remove(m)
+		ele.SentTick = u.CurrentTick
+		ele.Naked = false
+		u.SendQueue.Remove(e)
+		u.SendHistory.PushBack(ele)
+		u.BytesInFlight += ele.Cap
+		if u.CC != nil {
+			u.CC.OnSent(ele.Cap)
+		}
+		e = next
 	}
 }
 
 func GenOutPackage(u *RUDP) *list.List {
 	tmp := TmpBuffer{}
 	tmp.Size = 0
+	tmp.Packages = list.New()
+
+	if !u.sentCapability {
+		PackCapability(u, &tmp)
+		u.sentCapability = true
+	}
 
 	RequestMissing(u, &tmp)
 	ReplyRequest(u, &tmp)
+	RetransmitExpired(u, &tmp)
 	SendMessage(u, &tmp)
 
-	if tmp.Packages.Front() == nil {
-		if tmp.Size == 0 {
-			tmp.Buf[0] = TypeIgnore
-			tmp.Size = 1
-		}
+	if tmp.Packages.Front() == nil && tmp.Size == 0 {
+		tmp.Buf[0] = TypeIgnore
+		tmp.Size = 1
 	}
 	NewPacakge(u, &tmp)
-	//return package
+	return tmp.Packages
 }
 
 func RUDPUpdate(u *RUDP, buf []byte, size int, tick int) *list.List {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.CurrentTick = u.CurrentTick + tick
-	ClearOutPacakge(u)
-	ExtractPackage(u, buf, size)
+
+	if u.fec != nil {
+		for _, payload := range u.fec.onShard(buf[:size]) {
+			ExtractPackage(u, payload, len(payload))
+		}
+	} else {
+		ExtractPackage(u, buf, size)
+	}
 
 	if u.CurrentTick > u.LastExpireTick+u.Expired {
-		ClearSendExpired(u, u.LastExpireTick)
+		ClearSendExpired(u, u.CurrentTick-u.Expired)
 		u.LastExpireTick = u.CurrentTick
 	}
 	if u.CurrentTick >= u.LastSendTick+u.SendDelay {
-		u.SendPackage = GenOutPackage(u)
+		pkgs := GenOutPackage(u)
+		if u.fec != nil {
+			pkgs = u.fec.encode(pkgs)
+		}
+		u.SendPackage = pkgs
 		u.LastSendTick = u.CurrentTick
 		return u.SendPackage
 	} else {
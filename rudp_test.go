@@ -0,0 +1,81 @@
+package rudp
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestConcurrentSendRecvUpdate exercises the pattern a Conn relies on: one
+// goroutine calling RUDPSend while another drives RUDPUpdate and RUDPRecv
+// on a ticker. Run with -race to catch regressions in the locking added
+// to RUDPSend/RUDPRecv/RUDPUpdate.
+func TestConcurrentSendRecvUpdate(t *testing.T) {
+	u := RUDPNew(1, 100)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			RUDPSend(u, []byte("hello"), 5)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			RUDPUpdate(u, nil, 0, 1)
+			RUDPRecv(u)
+		}
+	}()
+
+	wg.Wait()
+}
+
+// TestClearMessageQueueResetsList guards against the Remove-during-
+// iteration bug ClearMessageQueue used to have: it must empty the list
+// completely, not just drop its first element.
+func TestClearMessageQueueResetsList(t *testing.T) {
+	u := RUDPNew(1, 100)
+	RUDPSend(u, []byte("a"), 1)
+	RUDPSend(u, []byte("b"), 1)
+	RUDPSend(u, []byte("c"), 1)
+
+	ClearMessageQueue(u.SendQueue)
+
+	if n := u.SendQueue.Len(); n != 0 {
+		t.Fatalf("SendQueue.Len() = %d, want 0", n)
+	}
+}
+
+// TestInsertMessageFillsLowestGap guards against InsertMessage silently
+// dropping a packet that arrives out of order and sorts below everything
+// already queued - the back-to-front scan used to fall off the list
+// without inserting in that case.
+func TestInsertMessageFillsLowestGap(t *testing.T) {
+	u := RUDPNew(1, 100)
+	u.RecvIdMin, u.RecvIdMax = 5, 5
+
+	InsertMessage(u, 8, []byte("h"), 1)
+	InsertMessage(u, 9, []byte("i"), 1)
+	InsertMessage(u, 6, []byte("x"), 1)
+
+	if n := u.RecvQueue.Len(); n != 3 {
+		t.Fatalf("RecvQueue.Len() = %d, want 3", n)
+	}
+
+	var ids []int
+	for e := u.RecvQueue.Front(); e != nil; e = e.Next() {
+		ids = append(ids, e.Value.(*Message).ID)
+	}
+	want := []int{6, 8, 9}
+	if len(ids) != len(want) {
+		t.Fatalf("RecvQueue IDs = %v, want %v", ids, want)
+	}
+	for i, id := range want {
+		if ids[i] != id {
+			t.Fatalf("RecvQueue IDs = %v, want %v", ids, want)
+		}
+	}
+}
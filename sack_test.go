@@ -0,0 +1,124 @@
+package rudp
+
+import (
+	"container/list"
+	"testing"
+)
+
+// newTmpBuffer returns a TmpBuffer ready for the Pack* helpers, mirroring
+// what GenOutPackage sets up.
+func newTmpBuffer() *TmpBuffer {
+	return &TmpBuffer{Packages: list.New()}
+}
+
+// flushTmpBuffer runs NewPacakge and returns the single resulting package's
+// bytes - a test helper for exercising one Pack* call at a time.
+func flushTmpBuffer(t *testing.T, u *RUDP, tmp *TmpBuffer) RUDPPackage {
+	t.Helper()
+	NewPacakge(u, tmp)
+	e := tmp.Packages.Back()
+	if e == nil {
+		t.Fatal("flushTmpBuffer: no package produced")
+	}
+	return e.Value.(RUDPPackage)
+}
+
+// TestCapabilityNegotiation exercises PackCapability/ExtractPackage end to
+// end: a peer that has not yet received a TypeCapability frame must not be
+// treated as SACK-capable, and must become so once one arrives advertising
+// CapSack.
+func TestCapabilityNegotiation(t *testing.T) {
+	sender := RUDPNew(1, 100)
+	receiver := RUDPNew(1, 100)
+
+	if receiver.PeerSackCapable {
+		t.Fatal("PeerSackCapable = true before any TypeCapability frame arrived")
+	}
+
+	tmp := newTmpBuffer()
+	PackCapability(sender, tmp)
+	pkg := flushTmpBuffer(t, sender, tmp)
+
+	ExtractPackage(receiver, pkg.Buf, pkg.Size)
+
+	if !receiver.PeerSackCapable {
+		t.Fatal("PeerSackCapable = false after a CapSack-advertising TypeCapability frame")
+	}
+	if receiver.Corrupt != 0 {
+		t.Fatalf("receiver.Corrupt = %d after a well-formed TypeCapability frame", receiver.Corrupt)
+	}
+}
+
+// TestCapabilityNegotiationWithoutSack checks the other direction: a peer
+// that advertises LocalSackCapable=false must not flip PeerSackCapable on.
+func TestCapabilityNegotiationWithoutSack(t *testing.T) {
+	sender := RUDPNew(1, 100)
+	sender.LocalSackCapable = false
+	receiver := RUDPNew(1, 100)
+
+	tmp := newTmpBuffer()
+	PackCapability(sender, tmp)
+	pkg := flushTmpBuffer(t, sender, tmp)
+
+	ExtractPackage(receiver, pkg.Buf, pkg.Size)
+
+	if receiver.PeerSackCapable {
+		t.Fatal("PeerSackCapable = true after a TypeCapability frame that did not advertise CapSack")
+	}
+}
+
+// TestPackAndApplySackRange exercises PackSackRange/ExtractPackage/
+// ApplySackRange together: it builds the frame a peer would send back to
+// report which of baseID's ids it has, then checks that applying it against
+// the original sender's SendHistory acks the present ones and queues the
+// gaps for retransmission.
+func TestPackAndApplySackRange(t *testing.T) {
+	sender := RUDPNew(1, 100)
+	for id := 1; id <= 3; id++ {
+		m := NewMessage(sender, []byte("x"), 1)
+		m.ID = id
+		sender.SendHistory.PushBack(m)
+		sender.BytesInFlight += m.Cap
+	}
+
+	// Bits 0 and 2 set: ids baseID+0 (1) and baseID+2 (3) are acked,
+	// baseID+1 (2) is missing.
+	bitmap := []byte{0b101}
+	tmp := newTmpBuffer()
+	PackSackRange(sender, tmp, 1, bitmap)
+	pkg := flushTmpBuffer(t, sender, tmp)
+
+	ExtractPackage(sender, pkg.Buf, pkg.Size)
+
+	if sender.Corrupt != 0 {
+		t.Fatalf("sender.Corrupt = %d after a well-formed TypeSackRange frame", sender.Corrupt)
+	}
+	if e := findSendHistoryElement(sender, 1); e != nil {
+		t.Fatal("id 1 still in SendHistory after being acked via SACK")
+	}
+	if e := findSendHistoryElement(sender, 3); e != nil {
+		t.Fatal("id 3 still in SendHistory after being acked via SACK")
+	}
+	msg2 := findSendHistory(sender, 2)
+	if msg2 == nil {
+		t.Fatal("id 2 missing from SendHistory, want it retained pending retransmit")
+	}
+	if !msg2.Naked {
+		t.Fatal("id 2's Naked = false after being reported missing via SACK")
+	}
+
+	wantInFlight := msg2.Cap
+	if sender.BytesInFlight != wantInFlight {
+		t.Fatalf("BytesInFlight = %d, want %d", sender.BytesInFlight, wantInFlight)
+	}
+
+	found := false
+	for _, id := range sender.SendAgain.A {
+		if id == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("SendAgain.A does not contain id 2 after it was reported missing via SACK")
+	}
+}
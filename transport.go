@@ -0,0 +1,392 @@
+package rudp
+
+import (
+	"container/list"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTickInterval is the wall-clock period between protocol ticks used
+// by a Config that does not specify one.
+const DefaultTickInterval = 20 * time.Millisecond
+
+// Config controls the timing parameters of a Conn or Listener.
+type Config struct {
+	// SendDelay and Expire are forwarded to RUDPNew: SendDelay is the
+	// number of ticks between outgoing flushes, Expire is the number of
+	// ticks an unacknowledged send survives in SendHistory.
+	SendDelay int
+	Expire    int
+	// TickInterval is the wall-clock duration of one protocol tick. Zero
+	// means DefaultTickInterval.
+	TickInterval time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.SendDelay == 0 {
+		c.SendDelay = 1
+	}
+	if c.Expire == 0 {
+		c.Expire = 100
+	}
+	if c.TickInterval == 0 {
+		c.TickInterval = DefaultTickInterval
+	}
+	return c
+}
+
+// deadlineTimer implements the channel-closing deadline idiom: C() returns
+// a channel that is closed once the deadline elapses, and Set rearms it.
+type deadlineTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+func newDeadlineTimer() *deadlineTimer {
+	return &deadlineTimer{ch: make(chan struct{})}
+}
+
+func (d *deadlineTimer) Set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	select {
+	case <-d.ch:
+		d.ch = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		d.timer = nil
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.ch)
+		return
+	}
+	ch := d.ch
+	d.timer = time.AfterFunc(dur, func() { close(ch) })
+}
+
+func (d *deadlineTimer) C() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ch
+}
+
+// Conn is a net.Conn backed by an RUDP state machine. A background
+// goroutine ticks RUDPUpdate on cfg.TickInterval and drains the resulting
+// packages onto the underlying socket, so callers only ever see Read and
+// Write.
+type Conn struct {
+	u  *RUDP
+	// mu is held around each single call into u (RUDPUpdate, RUDPRecv,
+	// RUDPSend), on top of RUDP's own internal lock. It is released before
+	// flush writes to the socket and before Read waits for more data.
+	mu  sync.Mutex
+	cfg Config
+
+	local   net.Addr
+	remote  *net.UDPAddr
+	writeTo func([]byte) (int, error)
+	closer  io.Closer
+
+	recv    chan struct{} // signalled whenever RUDPRecv may have new data
+	closeCh chan struct{}
+	once    sync.Once
+
+	readDeadline  *deadlineTimer
+	writeDeadline *deadlineTimer
+
+	// onClose, if set, is called once as Close runs, after closeCh is
+	// closed but before the underlying socket is torn down. Listener
+	// uses it to forget the peer's entry in its conns map.
+	onClose func()
+}
+
+func newConn(u *RUDP, cfg Config, local net.Addr, remote *net.UDPAddr, writeTo func([]byte) (int, error)) *Conn {
+	return &Conn{
+		u:             u,
+		cfg:           cfg,
+		local:         local,
+		remote:        remote,
+		writeTo:       writeTo,
+		recv:          make(chan struct{}, 1),
+		closeCh:       make(chan struct{}),
+		readDeadline:  newDeadlineTimer(),
+		writeDeadline: newDeadlineTimer(),
+	}
+}
+
+// Dial opens a Conn to addr over its own dedicated net.UDPConn.
+func Dial(addr string, cfg Config) (*Conn, error) {
+	cfg = cfg.withDefaults()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(RUDPNew(cfg.SendDelay, cfg.Expire), cfg, uc.LocalAddr(), raddr, uc.Write)
+	c.closer = uc
+	go c.runTicker()
+	go c.readLoop(uc)
+	return c, nil
+}
+
+func (c *Conn) readLoop(uc *net.UDPConn) {
+	buf := make([]byte, DefaultPackageSize)
+	for {
+		n, err := uc.Read(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		c.deliver(data)
+	}
+}
+
+func (c *Conn) runTicker() {
+	t := time.NewTicker(c.cfg.TickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.tick(1)
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+func (c *Conn) tick(ticks int) {
+	c.mu.Lock()
+	out := RUDPUpdate(c.u, nil, 0, ticks)
+	c.mu.Unlock()
+	c.wake()
+	c.flush(out)
+}
+
+func (c *Conn) deliver(buf []byte) {
+	c.mu.Lock()
+	out := RUDPUpdate(c.u, buf, len(buf), 0)
+	c.mu.Unlock()
+	c.wake()
+	c.flush(out)
+}
+
+func (c *Conn) flush(out *list.List) {
+	if out == nil {
+		return
+	}
+	for e := out.Front(); e != nil; e = e.Next() {
+		pkg, ok := e.Value.(RUDPPackage)
+		if !ok {
+			continue
+		}
+		c.writeTo(pkg.Buf[:pkg.Size])
+	}
+}
+
+func (c *Conn) wake() {
+	select {
+	case c.recv <- struct{}{}:
+	default:
+	}
+}
+
+// Read blocks until a message is available, the deadline expires, or the
+// Conn is closed.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		data, err := RUDPRecv(c.u)
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if len(data) > 0 {
+			return copy(b, data), nil
+		}
+		select {
+		case <-c.recv:
+			continue
+		case <-c.readDeadline.C():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closeCh:
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write enqueues b as a single message; the background ticker is
+// responsible for actually putting it on the wire.
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.C():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	c.mu.Lock()
+	RUDPSend(c.u, b, len(b))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+		if c.onClose != nil {
+			c.onClose()
+		}
+		if c.closer != nil {
+			c.closer.Close()
+		}
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+// Listener accepts Conns multiplexed over a single net.UDPConn,
+// demultiplexing incoming datagrams to per-peer RUDP instances by remote
+// address.
+type Listener struct {
+	pc  *net.UDPConn
+	cfg Config
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+
+	acceptCh chan *Conn
+	closeCh  chan struct{}
+	once     sync.Once
+}
+
+// Listen starts accepting RUDP connections on addr.
+func Listen(addr string, cfg Config) (*Listener, error) {
+	cfg = cfg.withDefaults()
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		pc:       pc,
+		cfg:      cfg,
+		conns:    make(map[string]*Conn),
+		acceptCh: make(chan *Conn, 64),
+		closeCh:  make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, DefaultPackageSize)
+	for {
+		n, raddr, err := l.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		l.conn(raddr).deliver(data)
+	}
+}
+
+// conn returns the Conn for raddr, creating and accepting it if this is
+// the first datagram seen from that peer.
+func (l *Listener) conn(raddr *net.UDPAddr) *Conn {
+	key := raddr.String()
+
+	l.mu.Lock()
+	if c, ok := l.conns[key]; ok {
+		l.mu.Unlock()
+		return c
+	}
+	remote := *raddr
+	c := newConn(RUDPNew(l.cfg.SendDelay, l.cfg.Expire), l.cfg, l.pc.LocalAddr(), &remote, func(b []byte) (int, error) {
+		return l.pc.WriteToUDP(b, &remote)
+	})
+	c.onClose = func() { l.forget(key) }
+	l.conns[key] = c
+	l.mu.Unlock()
+
+	go c.runTicker()
+	select {
+	case l.acceptCh <- c:
+	case <-l.closeCh:
+	}
+	return c
+}
+
+// Accept returns the next incoming Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// forget removes key's Conn from l.conns, so a peer that reconnects after
+// closing its prior Conn gets a fresh session instead of the dead one.
+func (l *Listener) forget(key string) {
+	l.mu.Lock()
+	delete(l.conns, key)
+	l.mu.Unlock()
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closeCh)
+		l.pc.Close()
+		l.mu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+		// Each Close below runs onClose, which locks l.mu itself, so the
+		// Closes run on the snapshot above after l.mu is released.
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
@@ -0,0 +1,102 @@
+package rudp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestLoopback exercises Listen/Dial/Accept over a real UDP loopback pair
+// and checks a message round trips through both Conns.
+func TestLoopback(t *testing.T) {
+	cfg := Config{TickInterval: time.Millisecond}
+
+	ln, err := Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := Dial(ln.Addr().String(), cfg)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.(*Conn)
+	}()
+
+	want := []byte("hello over loopback")
+	if _, err := client.Write(want); err != nil {
+		t.Fatalf("client.Write: %v", err)
+	}
+
+	var server *Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Accept")
+	}
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, DefaultPackageSize)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("server.Read: %v", err)
+	}
+	if got := string(buf[:n]); got != string(want) {
+		t.Fatalf("server.Read = %q, want %q", got, want)
+	}
+
+	reply := []byte("hello back")
+	if _, err := server.Write(reply); err != nil {
+		t.Fatalf("server.Write: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatalf("client.Read: %v", err)
+	}
+	if got := string(buf[:n]); got != string(reply) {
+		t.Fatalf("client.Read = %q, want %q", got, reply)
+	}
+}
+
+// TestListenerForgetsClosedPeers guards against Listener.conns growing
+// without bound and against a reconnecting peer being handed back its own
+// dead Conn: once a peer's Conn is Closed, its map entry must be gone so the
+// next datagram from that address starts a fresh session.
+func TestListenerForgetsClosedPeers(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", Config{})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr: %v", err)
+	}
+
+	first := ln.conn(raddr)
+	if n := len(ln.conns); n != 1 {
+		t.Fatalf("len(ln.conns) after first conn = %d, want 1", n)
+	}
+
+	first.Close()
+	if n := len(ln.conns); n != 0 {
+		t.Fatalf("len(ln.conns) after Close = %d, want 0", n)
+	}
+
+	second := ln.conn(raddr)
+	if second == first {
+		t.Fatal("conn() returned the closed Conn for a reconnecting peer, want a fresh one")
+	}
+}